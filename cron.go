@@ -0,0 +1,178 @@
+package pgq
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/joomcode/errorx"
+	cron "github.com/robfig/cron/v3"
+)
+
+// cronParser understands standard 5-field cron syntax: minute hour day-of-month month
+// day-of-week.
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
+
+// cronJob is what a Worker remembers in memory about a schedule it registered with
+// RegisterCron, so it can compute the next run time and re-apply the original JobOptions on
+// every tick it wins. Expects a pgq_schedules table (id, spec, queue, data, next_run_at,
+// last_enqueued_at) with a unique index on (queue, spec), so registering the same schedule twice
+// (the normal thing an app does on every restart) updates the existing row instead of creating a
+// second one.
+type cronJob struct {
+	schedule cron.Schedule
+	queue    string
+	data     []byte
+	options  []JobOption
+}
+
+// RegisterCron enqueues a job onto queueName, using the enqueueJob, every time spec fires.  spec
+// is standard 5-field cron syntax.  The schedule is persisted in pgq_schedules; every worker
+// process that has called RegisterCron polls that table with SELECT ... FOR UPDATE SKIP LOCKED,
+// so only one of them wins the right to enqueue any given tick, and a schedule's JobOptions are
+// only honored by the process that registered it. Calling RegisterCron again with a queue/spec
+// pair that's already registered updates that schedule's payload in place, rather than creating a
+// second schedule that would double-fire it — next_run_at is left untouched by the update, so an
+// app restart doesn't reset or skew the clock either.
+func (worker *Worker) RegisterCron(spec string, queueName string, data []byte, opts ...JobOption) error {
+	if err := requireSQLXDB(worker, "RegisterCron"); err != nil {
+		return err
+	}
+	schedule, err := cronParser.Parse(spec)
+	if err != nil {
+		return errorx.Decorate(err, "could not parse cron spec")
+	}
+
+	var id int
+	err = worker.db.Get(
+		&id,
+		`INSERT INTO pgq_schedules (spec, queue, data, next_run_at) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (queue, spec) DO UPDATE SET data = EXCLUDED.data
+		 RETURNING id`,
+		spec, queueName, data, schedule.Next(time.Now()),
+	)
+	if err != nil {
+		return errorx.Decorate(err, "could not register cron schedule")
+	}
+
+	worker.cronMu.Lock()
+	worker.crons[id] = &cronJob{schedule: schedule, queue: queueName, data: data, options: opts}
+	worker.cronMu.Unlock()
+	return nil
+}
+
+// runCronLoop polls pgq_schedules for due schedules until the worker's context is cancelled.  Run
+// only starts it once at least one cron has been registered.
+func (worker *Worker) runCronLoop() {
+	for {
+		select {
+		case <-worker.ctx.Done():
+			return
+		default:
+		}
+
+		fired, err := worker.tickCron()
+		if err != nil {
+			worker.log.Error().Err(err).Msg("tickCron")
+		}
+		if !fired {
+			select {
+			case <-worker.ctx.Done():
+				return
+			case <-time.After(worker.cronPollingInterval):
+			}
+		}
+	}
+}
+
+// tickCron claims at most one due schedule and enqueues its job in the same transaction as
+// advancing next_run_at, so a crash can't double-fire or lose a tick.  It returns true if it
+// found a due schedule, whether or not enqueueing succeeded, so runCronLoop can check for more
+// due schedules right away instead of sleeping a full polling interval.
+func (worker *Worker) tickCron() (fired bool, outErr error) {
+	tx, err := worker.db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		commitErr := tx.Commit()
+		if commitErr == sql.ErrTxDone {
+			// backOff has already rolled tx back.
+			commitErr = nil
+		}
+		outErr = errorx.DecorateMany("error ticking cron schedules", outErr, commitErr)
+	}()
+
+	var due struct {
+		ID    int    `db:"id"`
+		Spec  string `db:"spec"`
+		Queue string `db:"queue"`
+		Data  []byte `db:"data"`
+	}
+	err = tx.Get(
+		&due,
+		`SELECT id, spec, queue, data FROM pgq_schedules WHERE next_run_at <= now() FOR UPDATE SKIP LOCKED LIMIT 1`,
+	)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// backOff rolls tx back before backing off, releasing tx's FOR UPDATE lock on the row, which
+	// backOffCronSchedule's separate UPDATE would otherwise wait on forever.
+	backOff := func(causeErr error) error {
+		_ = tx.Rollback()
+		return worker.backOffCronSchedule(due.ID, causeErr)
+	}
+
+	worker.cronMu.Lock()
+	job, known := worker.crons[due.ID]
+	worker.cronMu.Unlock()
+
+	var schedule cron.Schedule
+	var options []JobOption
+	if known {
+		schedule = job.schedule
+		options = job.options
+	} else {
+		// Another process (or an earlier run of this one) registered this schedule; we only have
+		// its spec, so re-parse it and enqueue without the original JobOptions.
+		schedule, err = cronParser.Parse(due.Spec)
+		if err != nil {
+			return true, backOff(errorx.Decorate(err, "could not parse stored cron spec"))
+		}
+	}
+
+	if _, err = enqueueJob(tx, due.Queue, due.Data, options...); err != nil {
+		// enqueueJob's failure has already put tx in an aborted state, so next_run_at can't be
+		// advanced in this transaction: back off in a fresh statement instead, or this row stays
+		// due and FOR UPDATE SKIP LOCKED hands it straight back out next tick, with no delay.
+		return true, backOff(errorx.Decorate(err, "could not enqueue cron job"))
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(
+		`UPDATE pgq_schedules SET next_run_at = $1, last_enqueued_at = $2 WHERE id = $3`,
+		schedule.Next(now), now, due.ID,
+	)
+	if err != nil {
+		return true, backOff(errorx.Decorate(err, "could not advance cron schedule"))
+	}
+
+	return true, nil
+}
+
+// backOffCronSchedule pushes a schedule's next_run_at out by one cronPollingInterval in its own
+// statement, separate from tickCron's transaction (which tickCron rolls back before calling this,
+// so the row is no longer locked). Without it, a schedule that fails every attempt — a bad queue name, a DB hiccup
+// on the UPDATE — would stay due forever and get claimed again on the very next tickCron call,
+// busy-looping runCronLoop at full speed across every worker process that registered it instead of
+// waiting out the normal polling cadence.
+func (worker *Worker) backOffCronSchedule(id int, causeErr error) error {
+	_, err := worker.db.Exec(
+		`UPDATE pgq_schedules SET next_run_at = now() + make_interval(secs => $1) WHERE id = $2`,
+		worker.cronPollingInterval.Seconds(), id,
+	)
+	return errorx.DecorateMany("could not back off cron schedule after a failed tick", causeErr, err)
+}
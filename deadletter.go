@@ -0,0 +1,93 @@
+package pgq
+
+import (
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// A DeadJob is a job that exhausted its RetryWaits (or its queue's MaxAttempts) without
+// succeeding, and was moved off the queue instead of being silently discarded. Expects a
+// pgq_dead_jobs table with columns matching this struct's db tags, created the same way as
+// pgq_jobs.
+type DeadJob struct {
+	ID          int       `db:"id"`
+	QueueName   string    `db:"queue_name"`
+	Data        []byte    `db:"data"`
+	LastError   string    `db:"last_error"`
+	Attempts    int       `db:"attempts"`
+	FirstSeenAt time.Time `db:"first_seen_at"`
+	DiedAt      time.Time `db:"died_at"`
+}
+
+// deadLetter records a job that has run out of attempts into pgq_dead_jobs, in the same
+// transaction as the delete/update of its pgq_jobs row, so a crash can't lose or duplicate it.
+func deadLetter(tx DB, job *Job, attempts int, lastErr error, firstSeenAt time.Time) error {
+	_, err := tx.Exec(
+		`INSERT INTO pgq_dead_jobs (queue_name, data, last_error, attempts, first_seen_at, died_at)
+		 VALUES ($1, $2, $3, $4, $5, now())`,
+		job.QueueName, job.Data, lastErr.Error(), attempts, firstSeenAt,
+	)
+	return err
+}
+
+// ListDeadJobs returns up to limit dead jobs for the given queue, most recently died first.
+func (worker *Worker) ListDeadJobs(queueName string, limit int) ([]DeadJob, error) {
+	if err := requireSQLXDB(worker, "ListDeadJobs"); err != nil {
+		return nil, err
+	}
+	var deadJobs []DeadJob
+	err := worker.db.Select(
+		&deadJobs,
+		`SELECT id, queue_name, data, last_error, attempts, first_seen_at, died_at
+		 FROM pgq_dead_jobs WHERE queue_name = $1 ORDER BY died_at DESC LIMIT $2`,
+		queueName, limit,
+	)
+	if err != nil {
+		return nil, errorx.Decorate(err, "could not list dead jobs")
+	}
+	return deadJobs, nil
+}
+
+// RequeueDeadJob puts a dead job back on its original queue for a fresh set of attempts, and
+// removes it from pgq_dead_jobs. It returns the new job's ID.
+func (worker *Worker) RequeueDeadJob(id int, options ...JobOption) (newID int, outErr error) {
+	if err := requireSQLXDB(worker, "RequeueDeadJob"); err != nil {
+		return 0, err
+	}
+	tx, err := worker.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		outErr = errorx.DecorateMany("error requeueing dead job", outErr, tx.Commit())
+	}()
+
+	var deadJob DeadJob
+	if outErr = tx.Get(&deadJob, `SELECT id, queue_name, data FROM pgq_dead_jobs WHERE id = $1 FOR UPDATE`, id); outErr != nil {
+		return 0, errorx.Decorate(outErr, "could not find dead job")
+	}
+
+	newID, outErr = enqueueJob(tx, deadJob.QueueName, deadJob.Data, options...)
+	if outErr != nil {
+		return 0, errorx.Decorate(outErr, "could not requeue dead job")
+	}
+
+	if _, outErr = tx.Exec(`DELETE FROM pgq_dead_jobs WHERE id = $1`, id); outErr != nil {
+		return 0, errorx.Decorate(outErr, "could not remove dead job after requeueing")
+	}
+
+	return newID, outErr
+}
+
+// PurgeDeadJob permanently removes a dead job without requeueing it.
+func (worker *Worker) PurgeDeadJob(id int) error {
+	if err := requireSQLXDB(worker, "PurgeDeadJob"); err != nil {
+		return err
+	}
+	_, err := worker.db.Exec(`DELETE FROM pgq_dead_jobs WHERE id = $1`, id)
+	if err != nil {
+		return errorx.Decorate(err, "could not purge dead job")
+	}
+	return nil
+}
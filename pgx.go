@@ -0,0 +1,211 @@
+package pgq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joomcode/errorx"
+)
+
+// pgxBackend is a Backend built on pgx/v5 instead of lib/pq and sqlx. pgx supports binary
+// encoding and connection-level features like LISTEN/NOTIFY that database/sql can't cleanly
+// express, which is what lets this backend wake workers up immediately on enqueue (see Listen)
+// instead of making them wait out JobPollingInterval. It expects the same pgq_jobs table as the
+// default backend: id, queue_name, data, run_after, retry_waits (bigint[] of milliseconds), attempt,
+// first_seen_at, fingerprint, fingerprint_expires_at, and (for UpdateJob) ran_at and error.
+type pgxBackend struct {
+	pool *pgxpool.Pool
+}
+
+// NewPgxBackend wraps an existing pgx/v5 pool as a Backend. Pass the result to
+// NewWorkerWithBackend.
+func NewPgxBackend(pool *pgxpool.Pool) Backend {
+	return &pgxBackend{pool: pool}
+}
+
+// NewPgxWorker is a convenience wrapper around NewWorkerWithBackend(NewPgxBackend(pool), ...).
+func NewPgxWorker(pool *pgxpool.Pool, options ...WorkerOption) *Worker {
+	return NewWorkerWithBackend(NewPgxBackend(pool), options...)
+}
+
+func (b *pgxBackend) BeginTx() (BackendTx, error) {
+	tx, err := b.pool.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &pgxBackendTx{tx: tx, ctx: context.Background()}, nil
+}
+
+// Listen opens a dedicated connection and LISTENs on pgq_new_job_<queue> for each of queueNames,
+// returning a channel of queue names that have a new job to check. The channel is closed, with
+// nothing further sent on it, if the underlying connection is lost; callers should keep
+// polling on JobPollingInterval regardless; Listen is a latency optimization, not a guarantee.
+func (b *pgxBackend) Listen(ctx context.Context, queueNames []string) (<-chan string, error) {
+	conn, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, queueName := range queueNames {
+		if _, err := conn.Exec(ctx, fmt.Sprintf("LISTEN %s", pgx.Identifier{"pgq_new_job_" + queueName}.Sanitize())); err != nil {
+			conn.Release()
+			return nil, errorx.Decorate(err, fmt.Sprintf("could not listen on queue %q", queueName))
+		}
+	}
+
+	wake := make(chan string, len(queueNames))
+	go func() {
+		defer conn.Release()
+		defer close(wake)
+		for {
+			notification, err := conn.Conn().WaitForNotification(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case wake <- notification.Channel:
+			default:
+				// nobody's listening right now; the next poll will pick the job up anyway.
+			}
+		}
+	}()
+	return wake, nil
+}
+
+type pgxBackendTx struct {
+	tx  pgx.Tx
+	ctx context.Context
+}
+
+func (t *pgxBackendTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	tag, err := t.tx.Exec(t.ctx, query, args...)
+	return pgxResult{tag: tag}, err
+}
+
+// Enqueue builds and applies JobOptions to a *Job itself, the same way sqlxBackendTx.Enqueue's
+// shared enqueueJob does, and runs its own INSERT through pgx's QueryRow/Scan rather than calling
+// enqueueJob. That means a new JobOption or a change to how options are applied has to be kept in
+// sync by hand between the two backends.
+func (t *pgxBackendTx) Enqueue(queueName string, data []byte, options ...JobOption) (int, error) {
+	job := &Job{QueueName: queueName, Data: data}
+	for _, option := range options {
+		option(job)
+	}
+	if job.Attempt == 0 {
+		job.Attempt = 1
+	}
+	if job.FirstSeenAt.IsZero() {
+		job.FirstSeenAt = time.Now()
+	}
+
+	// fingerprint/fingerprintExpiresAt are only bound when Unique set them; a job enqueued without
+	// Unique gets a NULL fingerprint, which the unique index on pgq_jobs.fingerprint ignores, so
+	// ordinary jobs never conflict with each other.
+	var fingerprint *string
+	var fingerprintExpiresAt *time.Time
+	if job.Fingerprint != "" {
+		fingerprint = &job.Fingerprint
+		fingerprintExpiresAt = &job.FingerprintExpiresAt
+	}
+
+	var id int
+	err := t.tx.QueryRow(
+		t.ctx,
+		`INSERT INTO pgq_jobs (queue_name, data, run_after, retry_waits, attempt, first_seen_at, fingerprint, fingerprint_expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 ON CONFLICT (fingerprint) DO NOTHING
+		 RETURNING id`,
+		job.QueueName, job.Data, job.RunAfter, durationsToMillis(job.RetryWaits), job.Attempt, job.FirstSeenAt, fingerprint, fingerprintExpiresAt,
+	).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrDuplicateJob
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// best-effort wakeup for any pgxBackend.Listen-ers; a failed NOTIFY just means they fall back
+	// to their next poll.
+	_, _ = t.tx.Exec(t.ctx, fmt.Sprintf("NOTIFY %s", pgx.Identifier{"pgq_new_job_" + queueName}.Sanitize()))
+
+	return id, nil
+}
+
+func (t *pgxBackendTx) NextJob(queueNames []string) (*Job, error) {
+	var job Job
+	var retryWaitsMillis []int64
+	err := t.tx.QueryRow(
+		t.ctx,
+		`SELECT id, queue_name, data, retry_waits, attempt, first_seen_at FROM pgq_jobs
+		 WHERE queue_name = ANY($1) AND run_after <= now()
+		 ORDER BY run_after ASC
+		 FOR UPDATE SKIP LOCKED LIMIT 1`,
+		queueNames,
+	).Scan(&job.ID, &job.QueueName, &job.Data, &retryWaitsMillis, &job.Attempt, &job.FirstSeenAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.RetryWaits = millisToDurations(retryWaitsMillis)
+	return &job, nil
+}
+
+func (t *pgxBackendTx) DeleteJob(job *Job) error {
+	_, err := t.tx.Exec(t.ctx, `DELETE FROM pgq_jobs WHERE id = $1`, job.ID)
+	return err
+}
+
+func (t *pgxBackendTx) UpdateJob(job *Job, ranAt time.Time, jobErr error) error {
+	var errText *string
+	if jobErr != nil {
+		text := jobErr.Error()
+		errText = &text
+	}
+	_, err := t.tx.Exec(
+		t.ctx,
+		`UPDATE pgq_jobs SET ran_at = $1, error = $2 WHERE id = $3`,
+		ranAt, errText, job.ID,
+	)
+	return err
+}
+
+func (t *pgxBackendTx) Commit() error {
+	return t.tx.Commit(t.ctx)
+}
+
+// pgxResult adapts a pgx CommandTag to the database/sql.Result interface that BackendTx (and the
+// dead-letter queue, which takes a plain DB) expect.
+type pgxResult struct {
+	tag pgconn.CommandTag
+}
+
+func (r pgxResult) LastInsertId() (int64, error) {
+	return 0, errors.New("pgq: LastInsertId is not supported by the pgx backend")
+}
+
+func (r pgxResult) RowsAffected() (int64, error) {
+	return r.tag.RowsAffected(), nil
+}
+
+func durationsToMillis(durations []time.Duration) []int64 {
+	millis := make([]int64, len(durations))
+	for i, d := range durations {
+		millis[i] = d.Milliseconds()
+	}
+	return millis
+}
+
+func millisToDurations(millis []int64) []time.Duration {
+	durations := make([]time.Duration, len(millis))
+	for i, ms := range millis {
+		durations[i] = time.Duration(ms) * time.Millisecond
+	}
+	return durations
+}
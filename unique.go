@@ -0,0 +1,37 @@
+package pgq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrDuplicateJob is returned by EnqueueJob and EnqueueJobInTx when the job was enqueued with
+// Unique and another job with the same queue and key is already on pgq_jobs, so this enqueue was
+// suppressed. Whether that earlier job's ttl has passed is not checked.
+var ErrDuplicateJob = errors.New("pgq: duplicate job suppressed")
+
+// Unique makes a job's enqueue a no-op, returning ErrDuplicateJob instead of a new ID, if a job
+// with the same queue and key is already sitting in pgq_jobs. It expects a fingerprint column on
+// pgq_jobs with a unique index, and relies on the same INSERT ... ON CONFLICT (fingerprint) DO
+// NOTHING that enqueueJob already issues for every job, so concurrent callers race safely with no
+// separate table or transaction to reason about. That also means suppression only lasts as long as
+// the earlier job's row does: with the default deleteJobOnComplete, the fingerprint frees up as
+// soon as that job finishes, and with PreserveCompletedJobs it lasts until the row is removed. ttl
+// is only recorded in fingerprint_expires_at; the ON CONFLICT check does not consult it, so the
+// dedupe window can be shorter or longer than ttl. Composes with any other JobOption, including
+// from RegisterCron.
+func Unique(key string, ttl time.Duration) JobOption {
+	return func(job *Job) {
+		job.Fingerprint = fingerprint(job.QueueName, key)
+		job.FingerprintExpiresAt = time.Now().Add(ttl)
+	}
+}
+
+// fingerprint returns the SHA-256 hash of a queue name and a caller-supplied dedupe key, hex
+// encoded for storage in pgq_jobs.fingerprint.
+func fingerprint(queueName, key string) string {
+	sum := sha256.Sum256([]byte(queueName + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
@@ -4,8 +4,12 @@
 package pgq
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -26,6 +30,7 @@ var (
 // that are there.
 type Worker struct {
 	db                  *sqlx.DB
+	backend             Backend
 	queues              map[string]*queue
 	jobPollingInterval  time.Duration
 	deleteJobOnComplete bool
@@ -33,24 +38,91 @@ type Worker struct {
 	onStop              func()
 	log                 *zerolog.Logger
 	verbose             bool
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	concurrency         int
+	cronMu              sync.Mutex
+	crons               map[int]*cronJob
+	cronPollingInterval time.Duration
+	onPanic             func(queueName string, jobID int, data []byte, recovered any, stack []byte)
 }
 
 type queue struct {
-	handler     func([]byte) error
+	handler     func(context.Context, []byte) error
+	jobTimeout  time.Duration
+	maxInFlight int32
+	inFlight    int32
+	maxAttempts int
+
+	// mu guards pausedUntil and backoff, which Concurrency's goroutines can all read (getQueueNames)
+	// and write (PerformNextJob) at once; inFlight doesn't need it because atomic covers a bare
+	// counter, but these two are read-then-written together.
+	mu          sync.Mutex
 	pausedUntil time.Time
 	backoff     time.Duration
 }
 
-// NewWorker takes a Postgres DB connection and returns a Worker instance.
+// ctxKey is an unexported type for the keys used to stash job metadata on a handler's context, so
+// it can't collide with keys set by other packages.
+type ctxKey int
+
+const (
+	ctxKeyJobID ctxKey = iota
+	ctxKeyQueueName
+	ctxKeyAttempt
+)
+
+// JobIDFromContext returns the ID of the job currently being handled, if ctx was passed down from
+// a RegisterQueueCtx handler.
+func JobIDFromContext(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(ctxKeyJobID).(int)
+	return id, ok
+}
+
+// QueueNameFromContext returns the name of the queue that the currently running job came from, if
+// ctx was passed down from a RegisterQueueCtx handler.
+func QueueNameFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(ctxKeyQueueName).(string)
+	return name, ok
+}
+
+// AttemptFromContext returns the 1-indexed attempt number of the job currently being handled, if
+// ctx was passed down from a RegisterQueueCtx handler.
+func AttemptFromContext(ctx context.Context) (int, bool) {
+	attempt, ok := ctx.Value(ctxKeyAttempt).(int)
+	return attempt, ok
+}
+
+// NewWorker takes a Postgres DB connection and returns a Worker instance backed by lib/pq and
+// sqlx. To use a different Backend (for example the pgx/v5 one, which adds LISTEN/NOTIFY-based
+// wakeups), use NewWorkerWithBackend instead.
 func NewWorker(db *sql.DB, options ...WorkerOption) *Worker {
+	sqlxDB := sqlx.NewDb(db, "postgres")
+	return newWorker(sqlxDB, newSQLXBackend(sqlxDB), options...)
+}
+
+// NewWorkerWithBackend returns a Worker instance that stores and retrieves jobs through backend
+// instead of the default lib/pq/sqlx implementation. See Backend, NewPgxBackend.
+func NewWorkerWithBackend(backend Backend, options ...WorkerOption) *Worker {
+	return newWorker(nil, backend, options...)
+}
+
+func newWorker(db *sqlx.DB, backend Backend, options ...WorkerOption) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
 	runner := &Worker{
 		StopChan:            make(chan bool),
-		db:                  sqlx.NewDb(db, "postgres"),
+		db:                  db,
+		backend:             backend,
 		queues:              map[string]*queue{},
 		jobPollingInterval:  time.Second * 10,
 		deleteJobOnComplete: true,
 		log:                 defaultLogger(),
 		verbose:             false,
+		ctx:                 ctx,
+		cancel:              cancel,
+		concurrency:         1,
+		crons:               map[int]*cronJob{},
+		cronPollingInterval: time.Second,
 	}
 	for _, option := range options {
 		option(runner)
@@ -58,6 +130,39 @@ func NewWorker(db *sql.DB, options ...WorkerOption) *Worker {
 	return runner
 }
 
+// enqueueJobViaBackend opens its own Backend transaction to insert a single job, separately from
+// the transaction PerformNextJob uses to dequeue and run one.
+func (worker *Worker) enqueueJobViaBackend(queueName string, data []byte, options ...JobOption) (id int, outErr error) {
+	tx, err := worker.backend.BeginTx()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		outErr = errorx.DecorateMany("error enqueueing job", outErr, tx.Commit())
+	}()
+	id, outErr = tx.Enqueue(queueName, data, options...)
+	return id, outErr
+}
+
+// withAttempt stashes the attempt number a retried job is on directly on its new row, so
+// PerformNextJob can enforce MaxAttempts by reading pgq_jobs instead of an in-process map that a
+// different worker process (or this one, after a restart) would have no entry for. It's
+// unexported: callers enqueueing a fresh job have no business setting their own attempt number.
+func withAttempt(n int) JobOption {
+	return func(job *Job) {
+		job.Attempt = n
+	}
+}
+
+// withFirstSeenAt carries a retried job's original enqueue time forward onto its new row, so
+// pgq_dead_jobs gets an accurate FirstSeenAt no matter which worker process eventually dead-letters
+// the job.
+func withFirstSeenAt(t time.Time) JobOption {
+	return func(job *Job) {
+		job.FirstSeenAt = t
+	}
+}
+
 func (worker *Worker) LogDebug(logFields map[string]interface{}, msg string) {
 	if worker.verbose {
 		log.Debug().Fields(logFields).Msg(msg)
@@ -66,7 +171,7 @@ func (worker *Worker) LogDebug(logFields map[string]interface{}, msg string) {
 
 // EnqueueJob puts a job on the queue.  If successful, it returns the Job ID.
 func (worker *Worker) EnqueueJob(queueName string, data []byte, options ...JobOption) (int, error) {
-	id, err := enqueueJob(worker.db, queueName, data, options...)
+	id, err := worker.enqueueJobViaBackend(queueName, data, options...)
 	logFields := make(map[string]interface{})
 	logFields["id"] = id
 	logFields["queueName"] = queueName
@@ -101,39 +206,169 @@ func (worker *Worker) EnqueueJobInTx(tx DB, queueName string, data []byte, optio
 // RegisterQueue tells your Worker instance which function should be called for a
 // given job type.
 func (worker *Worker) RegisterQueue(queueName string, jobFunc func([]byte) error) error {
+	return worker.RegisterQueueCtx(queueName, func(_ context.Context, data []byte) error {
+		return jobFunc(data)
+	})
+}
+
+// RegisterQueueCtx is like RegisterQueue, but the handler receives a context.Context carrying the
+// job ID, queue name, and attempt number (retrievable with JobIDFromContext, QueueNameFromContext,
+// and AttemptFromContext). The context is cancelled when the Worker is stopped, and, if JobTimeout
+// is given as a QueueOption, after that timeout elapses.
+func (worker *Worker) RegisterQueueCtx(queueName string, jobFunc func(context.Context, []byte) error, opts ...QueueOption) error {
 	if _, alreadyRegistered := worker.queues[queueName]; alreadyRegistered {
 		return fmt.Errorf("a handler for %s jobs has already been registered", queueName)
 	}
-	worker.queues[queueName] = &queue{handler: jobFunc}
+	q := &queue{handler: jobFunc}
+	for _, opt := range opts {
+		opt(q)
+	}
+	worker.queues[queueName] = q
 	return nil
 }
 
-// Run will query for the next job in the queue, then run it, then do another, forever.
+// A QueueOption sets an optional parameter on a registered queue.
+type QueueOption func(*queue)
+
+// JobTimeout bounds how long a single job's handler is allowed to run before its context is
+// cancelled. A handler that respects ctx.Done() will be asked to stop; PerformNextJob records the
+// resulting error as a failed attempt, same as any other handler error. There is no timeout by
+// default.
+func JobTimeout(d time.Duration) QueueOption {
+	return func(q *queue) {
+		q.jobTimeout = d
+	}
+}
+
+// MaxInFlight caps how many jobs from this queue may run at once across all of a Worker's
+// Concurrency goroutines, so one slow or high-volume queue can't starve the others. There is no
+// cap by default.
+func MaxInFlight(n int) QueueOption {
+	return func(q *queue) {
+		q.maxInFlight = int32(n)
+	}
+}
+
+// MaxAttempts caps how many times a job on this queue will be attempted before it is moved to
+// pgq_dead_jobs instead of being retried, even if RetryWaits has entries left. The attempt count is
+// read from the job's own row (see withAttempt), so the cap holds even if a retry is dequeued by a
+// different worker process than the one that enqueued it. There is no cap by default, so a job
+// runs out of attempts only when it runs out of RetryWaits.
+func MaxAttempts(n int) QueueOption {
+	return func(q *queue) {
+		q.maxAttempts = n
+	}
+}
+
+// Run launches Concurrency (default 1) goroutines that each query for the next job in the queue,
+// run it, then do another, forever. Postgres's SKIP LOCKED (via getNextJob) keeps the goroutines
+// from stepping on each other's jobs. When StopChan fires, every in-flight handler's context is
+// cancelled and Run waits for all goroutines to return before calling onStop.
 func (worker *Worker) Run(pollingOverride *time.Duration) error {
 	worker.log.Info().Fields(map[string]interface{}{"queueNames": worker.getQueueNames()}).Msg("Run")
-	defer func() {
-		worker.log.Info().Msg("Exiting")
-		if worker.onStop != nil {
-			worker.onStop()
+
+	concurrency := worker.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	go func() {
+		select {
+		case <-worker.StopChan:
+			worker.cancel()
+		case <-worker.ctx.Done():
 		}
 	}()
+
+	// If the Backend supports it (the pgx one does), LISTEN for new-job notifications so runLoop
+	// can wake up immediately instead of always waiting out jobPollingInterval.
+	var wake <-chan string
+	if listener, ok := worker.backend.(interface {
+		Listen(ctx context.Context, queueNames []string) (<-chan string, error)
+	}); ok {
+		ch, err := listener.Listen(worker.ctx, worker.getQueueNames())
+		if err != nil {
+			worker.log.Error().Err(err).Msg("Listen")
+		} else {
+			wake = ch
+		}
+	}
+
+	errCh := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			worker.runLoop(pollingOverride, errCh, wake)
+		}()
+	}
+
+	worker.cronMu.Lock()
+	hasCrons := len(worker.crons) > 0
+	worker.cronMu.Unlock()
+	if hasCrons {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker.runCronLoop()
+		}()
+	}
+
+	wg.Wait()
+
+	worker.log.Info().Msg("Exiting")
+	if worker.onStop != nil {
+		worker.onStop()
+	}
+
+	select {
+	case err := <-errCh:
+		return errorx.Decorate(err, "exiting job runner")
+	default:
+		return nil
+	}
+}
+
+// runLoop is the body of a single Run goroutine: it performs jobs until the worker's context is
+// cancelled or PerformNextJob returns an error, in which case it reports the error on errCh and
+// cancels the worker so sibling goroutines wind down too.
+func (worker *Worker) runLoop(pollingOverride *time.Duration, errCh chan<- error, wake <-chan string) {
 	for {
 		select {
-		case <-worker.StopChan:
-			return nil
+		case <-worker.ctx.Done():
+			return
 		default:
-			if attemptedJob, err := worker.PerformNextJob(); err != nil {
-				return errorx.Decorate(err, "exiting job runner")
-			} else if !attemptedJob {
-				// we didn't find a job.  Take a nap.
-				pollingInterval := worker.jobPollingInterval
-
-				// override polling time duration if provided
-				if pollingOverride != nil {
-					pollingInterval = *pollingOverride
-				}
+		}
 
-				time.Sleep(pollingInterval)
+		attemptedJob, err := worker.PerformNextJob()
+		if err != nil {
+			select {
+			case errCh <- err:
+			default:
+			}
+			worker.cancel()
+			return
+		}
+		if !attemptedJob {
+			// we didn't find a job.  Take a nap.
+			pollingInterval := worker.jobPollingInterval
+
+			// override polling time duration if provided
+			if pollingOverride != nil {
+				pollingInterval = *pollingOverride
+			}
+
+			select {
+			case <-worker.ctx.Done():
+				return
+			case _, ok := <-wake:
+				if !ok {
+					// Listen's connection is gone; a closed channel would fire on every select, so
+					// fall back to plain polling.
+					wake = nil
+				}
+			case <-time.After(pollingInterval):
 			}
 		}
 	}
@@ -143,9 +378,16 @@ func (worker *Worker) getQueueNames() []string {
 	names := []string{}
 	now := time.Now()
 	for k, v := range worker.queues {
-		if v.pausedUntil.Before(now) {
-			names = append(names, k)
+		v.mu.Lock()
+		pausedUntil := v.pausedUntil
+		v.mu.Unlock()
+		if !pausedUntil.Before(now) {
+			continue
+		}
+		if v.maxInFlight > 0 && atomic.LoadInt32(&v.inFlight) >= v.maxInFlight {
+			continue
 		}
+		names = append(names, k)
 	}
 	return names
 }
@@ -158,7 +400,7 @@ func (worker *Worker) PerformNextJob() (attempted bool, outErr error) {
 
 	// start an empty log entry that we'll append to throughout this func
 	logFields := make(map[string]interface{})
-	tx, err := worker.db.Beginx()
+	tx, err := worker.backend.BeginTx()
 	if err != nil {
 		return false, err
 	}
@@ -188,7 +430,7 @@ func (worker *Worker) PerformNextJob() (attempted bool, outErr error) {
 		return false, nil
 	}
 
-	job, err := getNextJob(tx, queueNames)
+	job, err := tx.NextJob(queueNames)
 	if err != nil {
 		return false, err
 	}
@@ -211,27 +453,64 @@ func (worker *Worker) PerformNextJob() (attempted bool, outErr error) {
 	ranAt := time.Now()
 	logFields["ranAt"] = ranAt
 
+	// attempt and firstSeenAt are read off the job row itself (see withAttempt/withFirstSeenAt),
+	// not process memory, so MaxAttempts and pgq_dead_jobs stay correct even if a retry is picked
+	// up by a different worker process than the one that enqueued it, or this one restarts.
+	attempt := job.Attempt
+	if attempt == 0 {
+		attempt = 1
+	}
+	firstSeenAt := job.FirstSeenAt
+	if firstSeenAt.IsZero() {
+		firstSeenAt = ranAt
+	}
+	logFields["attempt"] = attempt
+
+	jobCtx := context.WithValue(worker.ctx, ctxKeyJobID, job.ID)
+	jobCtx = context.WithValue(jobCtx, ctxKeyQueueName, job.QueueName)
+	jobCtx = context.WithValue(jobCtx, ctxKeyAttempt, attempt)
+	if queue.jobTimeout > 0 {
+		var cancel context.CancelFunc
+		jobCtx, cancel = context.WithTimeout(jobCtx, queue.jobTimeout)
+		defer cancel()
+	}
+
+	// claim one of the queue's MaxInFlight slots.  getQueueNames only read the count, so another
+	// goroutine may have taken the last slot since; if so, leave the job for a later poll.
+	if n := atomic.AddInt32(&queue.inFlight, 1); queue.maxInFlight > 0 && n > queue.maxInFlight {
+		atomic.AddInt32(&queue.inFlight, -1)
+		return false, nil
+	}
+
 	// run the job func in its own closure with its own panic handler.
 	func() {
+		defer atomic.AddInt32(&queue.inFlight, -1)
 		defer func() {
 			if r := recover(); r != nil {
+				stack := debug.Stack()
+				worker.callOnPanic(job.QueueName, job.ID, job.Data, r, stack)
 				panicErr := fmt.Errorf("%v", r)
 				jobErr = errorx.DecorateMany("panic in job handler", jobErr, panicErr)
 			}
 		}()
-		jobErr = queue.handler(job.Data)
+		jobErr = queue.handler(jobCtx, job.Data)
 	}()
 
+	if jobErr == nil && jobCtx.Err() == context.DeadlineExceeded {
+		logFields["timedOut"] = true
+		jobErr = fmt.Errorf("job timed out after %s", queue.jobTimeout)
+	}
+
 	// either delete the job from the queue, or update it with output, depending on how we've been
 	// configured.
 	if worker.deleteJobOnComplete {
-		err = deleteJob(tx, job)
+		err = tx.DeleteJob(job)
 		if err != nil {
 			return true, errorx.Decorate(err, "could not delete job")
 		}
 	} else {
 		// store the ranAt time and any error returned
-		err = updateJob(tx, job, ranAt, jobErr)
+		err = tx.UpdateJob(job, ranAt, jobErr)
 		if err != nil {
 			return true, errorx.Decorate(err, "could not update job")
 		}
@@ -241,6 +520,7 @@ func (worker *Worker) PerformNextJob() (attempted bool, outErr error) {
 		// handle backoffs
 		if b, ok := jobErr.(Backoffer); ok && b.Backoff() {
 			logFields["backoff"] = true
+			queue.mu.Lock()
 			// change multiplier if necessary
 			if queue.backoff == 0 {
 				queue.backoff = minBackoff
@@ -251,29 +531,42 @@ func (worker *Worker) PerformNextJob() (attempted bool, outErr error) {
 			if queue.backoff > maxBackoff {
 				queue.backoff = maxBackoff
 			}
+			queue.mu.Unlock()
 		}
 		// handle retries
-		if len(job.RetryWaits) > 0 {
+		outOfAttempts := queue.maxAttempts > 0 && attempt >= queue.maxAttempts
+		if len(job.RetryWaits) > 0 && !outOfAttempts {
 			// we errored, but we have more attempts.  Enqueue the next one for the future, after waiting
 			// the first attempt duration.  Store the rest of the attempt Durations on the new Job.
 			afterTime := time.Now().Add(job.RetryWaits[0])
 			logFields["retryAfter"] = afterTime
-			_, err = enqueueJob(
-				tx,
+			retryID, err := tx.Enqueue(
 				job.QueueName,
 				job.Data,
 				After(afterTime),
 				RetryWaits(job.RetryWaits[1:]),
+				withAttempt(attempt+1),
+				withFirstSeenAt(firstSeenAt),
 			)
 			if err != nil {
 				return true, errorx.Decorate(err, "error enqueueing retry")
 			}
+			logFields["retryID"] = retryID
+		} else {
+			// we're out of retries, or the queue's MaxAttempts cap kicked in early.  Don't let the
+			// job vanish: record it in pgq_dead_jobs so it can be inspected or replayed.
+			logFields["deadLettered"] = true
+			if err = deadLetter(tx, job, attempt, jobErr, firstSeenAt); err != nil {
+				return true, errorx.Decorate(err, "could not dead-letter job")
+			}
 		}
 	}
+	queue.mu.Lock()
 	if queue.backoff > 0 {
 		queue.pausedUntil = ranAt.Add(queue.backoff)
 		logFields["queuePausedUntil"] = queue.pausedUntil
 	}
+	queue.mu.Unlock()
 	return true, nil
 }
 
@@ -319,3 +612,46 @@ func SetVerbose(v bool) WorkerOption {
 		worker.verbose = v
 	}
 }
+
+// Concurrency sets how many goroutines Run launches to call PerformNextJob in parallel. Each
+// goroutine opens its own transaction and relies on getNextJob's SKIP LOCKED query to avoid
+// picking the same row as another goroutine. Default is 1, which matches the old serial behavior.
+func Concurrency(n int) WorkerOption {
+	return func(worker *Worker) {
+		worker.concurrency = n
+	}
+}
+
+// CronPollingInterval sets how often Run checks pgq_schedules for schedules registered with
+// RegisterCron that have come due. Default is 1 second. It has no effect if no crons are
+// registered.
+func CronPollingInterval(d time.Duration) WorkerOption {
+	return func(worker *Worker) {
+		worker.cronPollingInterval = d
+	}
+}
+
+// OnPanic sets a callback that's invoked, with the full stack trace, whenever a job handler
+// panics, so the panic can be shipped to something like Sentry with full payload context. f is
+// itself guarded by a recover, so a buggy callback can't take down the worker. There is no
+// callback by default; a panicking handler still just produces its usual "panic in job handler"
+// error.
+func OnPanic(f func(queueName string, jobID int, data []byte, recovered any, stack []byte)) WorkerOption {
+	return func(worker *Worker) {
+		worker.onPanic = f
+	}
+}
+
+// callOnPanic invokes the worker's OnPanic callback, if one is set, recovering from any panic
+// inside it so a buggy callback can't take the whole worker down with it.
+func (worker *Worker) callOnPanic(queueName string, jobID int, data []byte, recovered any, stack []byte) {
+	if worker.onPanic == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			worker.log.Error().Fields(map[string]interface{}{"recovered": r}).Msg("panic in OnPanic callback")
+		}
+	}()
+	worker.onPanic(queueName, jobID, data, recovered, stack)
+}